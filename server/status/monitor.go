@@ -0,0 +1,335 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Matt Tracy (matt.r.tracy@gmail.com)
+
+package status
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/uuid"
+)
+
+// CallSuccessEvent occurs whenever a backend call from a node completes
+// successfully. NodeStatusMonitor records it to maintain a running count of
+// successful calls per node, a per-method latency distribution, and
+// per-transaction call accounting keyed by TxnID.
+type CallSuccessEvent struct {
+	NodeID   proto.NodeID
+	Method   proto.Method
+	Duration time.Duration
+	TxnID    uuid.UUID
+}
+
+// CallErrorEvent occurs whenever a backend call from a node returns an
+// error. NodeStatusMonitor records it to maintain a running count of failed
+// calls per node, a per-method latency distribution, and per-transaction
+// call accounting keyed by TxnID.
+type CallErrorEvent struct {
+	NodeID   proto.NodeID
+	Method   proto.Method
+	Duration time.Duration
+	TxnID    uuid.UUID
+	// Retryable indicates the error represents a transaction restart (e.g.
+	// a serializable conflict) rather than a permanent failure. Only
+	// retryable errors are counted in the owning transaction's retries.
+	Retryable bool
+}
+
+const (
+	// latencyWindowSize bounds the number of per-method call latency samples
+	// NodeStatusMonitor retains, as a backstop against unbounded growth from
+	// a method called far more than latencyWindowDuration's worth of times
+	// per second. Once full, each new sample overwrites the oldest one.
+	latencyWindowSize = 1024
+	// latencyWindowDuration is the width of the sliding window over which
+	// per-method call latency quantiles are computed; samples older than
+	// this are excluded from snapshot. NodeStatusRecorder.Tick additionally
+	// resets the window at the end of every recording interval, so under
+	// normal load (one recording interval shorter than this duration) a
+	// snapshot only ever reflects calls made since the last tick.
+	latencyWindowDuration = time.Minute
+)
+
+// latencyNow returns the current time; it is a var so tests can substitute
+// a controllable clock instead of waiting on real time to observe window
+// eviction.
+var latencyNow = time.Now
+
+// methodLatency is a ring buffer of recent, timestamped call latencies for a
+// single (node, method) pair, used to compute approximate quantiles over the
+// last latencyWindowDuration.
+type methodLatency struct {
+	samples [latencyWindowSize]time.Duration
+	times   [latencyWindowSize]time.Time
+	next    int
+	count   int
+}
+
+// record adds a latency sample, overwriting the oldest sample once the
+// window is full.
+func (m *methodLatency) record(d time.Duration) {
+	m.samples[m.next] = d
+	m.times[m.next] = latencyNow()
+	m.next = (m.next + 1) % latencyWindowSize
+	if m.count < latencyWindowSize {
+		m.count++
+	}
+}
+
+// snapshot returns a copy of the latency samples recorded within the last
+// latencyWindowDuration, in no particular order.
+func (m *methodLatency) snapshot() []time.Duration {
+	cutoff := latencyNow().Add(-latencyWindowDuration)
+	out := make([]time.Duration, 0, m.count)
+	for i := 0; i < m.count; i++ {
+		if m.times[i].After(cutoff) {
+			out = append(out, m.samples[i])
+		}
+	}
+	return out
+}
+
+// reset clears the window, discarding every recorded sample. Called at the
+// end of each recording interval so quantiles reflect only the calls made
+// since the previous tick.
+func (m *methodLatency) reset() {
+	m.next = 0
+	m.count = 0
+}
+
+// callCount is a simple running tally of successful and failed calls.
+type callCount struct {
+	success int64
+	err     int64
+}
+
+// storeStatus maintains the accumulated per-store statistics needed to
+// generate store-level time series. Per-range MVCC stats are tracked
+// individually, keyed by the range's RaftID, so that a scan of all ranges
+// on a store (OnBeginScanRanges/OnRegisterRange/OnEndScanRanges) and
+// incremental per-range updates (OnUpdateRange) can both keep the store
+// total correct.
+type storeStatus struct {
+	storeID proto.StoreID
+	ranges  map[proto.RaftID]engine.MVCCStats
+
+	// scanRanges accumulates ranges discovered during an in-progress scan;
+	// it replaces ranges wholesale once the scan completes.
+	scanning   bool
+	scanRanges map[proto.RaftID]engine.MVCCStats
+
+	leaderRangeCount     int64
+	availableRangeCount  int64
+	replicatedRangeCount int64
+}
+
+func newStoreStatus(storeID proto.StoreID) *storeStatus {
+	return &storeStatus{
+		storeID: storeID,
+		ranges:  make(map[proto.RaftID]engine.MVCCStats),
+	}
+}
+
+// nodeStatus maintains the accumulated per-node statistics needed to
+// generate node-level time series.
+type nodeStatus struct {
+	nodeID  proto.NodeID
+	calls   callCount
+	methods map[proto.Method]*methodLatency
+}
+
+// recordLatency records a call latency sample against the given method,
+// creating its ring buffer on first use.
+func (n *nodeStatus) recordLatency(method proto.Method, d time.Duration) {
+	if n.methods == nil {
+		n.methods = make(map[proto.Method]*methodLatency)
+	}
+	ml, ok := n.methods[method]
+	if !ok {
+		ml = &methodLatency{}
+		n.methods[method] = ml
+	}
+	ml.record(d)
+}
+
+// NodeStatusMonitor accumulates statistics about a node and its stores by
+// observing the events broadcast by the storage and rpc layers. It is the
+// single point of collection for data subsequently exposed by a
+// NodeStatusRecorder.
+type NodeStatusMonitor struct {
+	sync.Mutex
+	stores map[proto.StoreID]*storeStatus
+	nodes  map[proto.NodeID]*nodeStatus
+
+	// txns and txnOrder together implement a size- and time-bounded LRU of
+	// recently active transactions; see touchTxnLocked. Both are lazily
+	// initialized by the first call that touches a transaction.
+	txns     map[uuid.UUID]*list.Element
+	txnOrder *list.List
+}
+
+// NewNodeStatusMonitor instantiates a new NodeStatusMonitor.
+func NewNodeStatusMonitor() *NodeStatusMonitor {
+	return &NodeStatusMonitor{
+		stores: make(map[proto.StoreID]*storeStatus),
+		nodes:  make(map[proto.NodeID]*nodeStatus),
+	}
+}
+
+// getStoreStatus returns the storeStatus for the given store, creating it
+// if it does not yet exist. The monitor's lock must be held.
+func (nsm *NodeStatusMonitor) getStoreStatus(storeID proto.StoreID) *storeStatus {
+	status, ok := nsm.stores[storeID]
+	if !ok {
+		status = newStoreStatus(storeID)
+		nsm.stores[storeID] = status
+	}
+	return status
+}
+
+// getNodeStatus returns the nodeStatus for the given node, creating it if
+// it does not yet exist. The monitor's lock must be held.
+func (nsm *NodeStatusMonitor) getNodeStatus(nodeID proto.NodeID) *nodeStatus {
+	status, ok := nsm.nodes[nodeID]
+	if !ok {
+		status = &nodeStatus{nodeID: nodeID}
+		nsm.nodes[nodeID] = status
+	}
+	return status
+}
+
+// resetLatencyWindows clears every per-method latency window across every
+// known node, so that the next recording interval's quantiles reflect only
+// calls made since this reset.
+func (nsm *NodeStatusMonitor) resetLatencyWindows() {
+	nsm.Lock()
+	defer nsm.Unlock()
+	for _, node := range nsm.nodes {
+		for _, ml := range node.methods {
+			ml.reset()
+		}
+	}
+}
+
+// OnBeginScanRanges is called when a store begins a full scan of its
+// ranges. Ranges collected via OnRegisterRange during the scan replace the
+// store's previously known set of ranges once OnEndScanRanges arrives.
+func (nsm *NodeStatusMonitor) OnBeginScanRanges(event *storage.BeginScanRangesEvent) {
+	nsm.Lock()
+	defer nsm.Unlock()
+	store := nsm.getStoreStatus(event.StoreID)
+	store.scanning = true
+	store.scanRanges = make(map[proto.RaftID]engine.MVCCStats)
+}
+
+// OnRegisterRange records a range discovered on a store, either as part of
+// an in-progress scan or as a standalone registration.
+func (nsm *NodeStatusMonitor) OnRegisterRange(event *storage.RegisterRangeEvent) {
+	nsm.Lock()
+	defer nsm.Unlock()
+	store := nsm.getStoreStatus(event.StoreID)
+	if event.Scan && store.scanning {
+		store.scanRanges[event.Desc.RaftID] = event.Stats
+		return
+	}
+	store.ranges[event.Desc.RaftID] = event.Stats
+}
+
+// OnEndScanRanges completes a store's range scan, replacing its previously
+// known set of ranges with those collected during the scan.
+func (nsm *NodeStatusMonitor) OnEndScanRanges(event *storage.EndScanRangesEvent) {
+	nsm.Lock()
+	defer nsm.Unlock()
+	store := nsm.getStoreStatus(event.StoreID)
+	store.ranges = store.scanRanges
+	store.scanRanges = nil
+	store.scanning = false
+}
+
+// OnUpdateRange applies an incremental MVCC stats delta to a single range,
+// as reported outside of a full store scan.
+func (nsm *NodeStatusMonitor) OnUpdateRange(event *storage.UpdateRangeEvent) {
+	nsm.Lock()
+	defer nsm.Unlock()
+	store := nsm.getStoreStatus(event.StoreID)
+	store.ranges[event.Desc.RaftID] = addMVCCStats(store.ranges[event.Desc.RaftID], event.Delta)
+}
+
+// OnReplicationStatus records the latest replication counts reported for a
+// store.
+func (nsm *NodeStatusMonitor) OnReplicationStatus(event *storage.ReplicationStatusEvent) {
+	nsm.Lock()
+	defer nsm.Unlock()
+	store := nsm.getStoreStatus(event.StoreID)
+	store.leaderRangeCount = event.LeaderRangeCount
+	store.availableRangeCount = event.AvailableRangeCount
+	store.replicatedRangeCount = event.ReplicatedRangeCount
+}
+
+// OnCallSuccess records a successful backend call against the given node,
+// along with its latency.
+func (nsm *NodeStatusMonitor) OnCallSuccess(event *CallSuccessEvent) {
+	nsm.Lock()
+	defer nsm.Unlock()
+	node := nsm.getNodeStatus(event.NodeID)
+	node.calls.success++
+	node.recordLatency(event.Method, event.Duration)
+	nsm.recordTxnCallLocked(event.TxnID, event.Method, event.Duration, false /* retryable */)
+}
+
+// OnCallError records a failed backend call against the given node, along
+// with its latency.
+func (nsm *NodeStatusMonitor) OnCallError(event *CallErrorEvent) {
+	nsm.Lock()
+	defer nsm.Unlock()
+	node := nsm.getNodeStatus(event.NodeID)
+	node.calls.err++
+	node.recordLatency(event.Method, event.Duration)
+	nsm.recordTxnCallLocked(event.TxnID, event.Method, event.Duration, event.Retryable)
+}
+
+// addMVCCStats returns the element-wise sum of two MVCCStats structs. It is
+// used to accumulate the stats of all ranges on a store into a single store
+// total.
+func addMVCCStats(a, b engine.MVCCStats) engine.MVCCStats {
+	a.LiveBytes += b.LiveBytes
+	a.KeyBytes += b.KeyBytes
+	a.ValBytes += b.ValBytes
+	a.IntentBytes += b.IntentBytes
+	a.LiveCount += b.LiveCount
+	a.KeyCount += b.KeyCount
+	a.ValCount += b.ValCount
+	a.IntentCount += b.IntentCount
+	a.IntentAge += b.IntentAge
+	a.GCBytesAge += b.GCBytesAge
+	a.LastUpdateNanos += b.LastUpdateNanos
+	return a
+}
+
+// sumMVCCStats returns the sum of the MVCC stats of every range in ranges.
+func sumMVCCStats(ranges map[proto.RaftID]engine.MVCCStats) engine.MVCCStats {
+	var totals engine.MVCCStats
+	for _, stats := range ranges {
+		totals = addMVCCStats(totals, stats)
+	}
+	return totals
+}
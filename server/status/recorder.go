@@ -0,0 +1,381 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Matt Tracy (matt.r.tracy@gmail.com)
+
+package status
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+const (
+	// storeTimeSeriesNameFmt is the format used for time series generated
+	// from store-level statistics; the parameters are the name of the
+	// statistic and the ID of the store it was collected from.
+	storeTimeSeriesNameFmt = "cr.store.%s-%d"
+	// nodeTimeSeriesNameFmt is the format used for time series generated
+	// from node-level statistics; the parameters are the name of the
+	// statistic and the ID of the node it was collected from.
+	nodeTimeSeriesNameFmt = "cr.node.%s-%d"
+)
+
+// storeStat describes a single store-level statistic: its name (shared by
+// the time series and Prometheus exporters) and how to compute its current
+// value from a store's accumulated state.
+type storeStat struct {
+	name  string
+	value func(store *storeStatus, totals engine.MVCCStats) float64
+}
+
+// storeStats enumerates every store-level statistic emitted by the
+// recorder. It is shared between GetTimeSeriesData and GetPrometheusMetrics
+// so the two exporters can never drift out of sync.
+var storeStats = []storeStat{
+	{"livebytes", func(_ *storeStatus, t engine.MVCCStats) float64 { return float64(t.LiveBytes) }},
+	{"keybytes", func(_ *storeStatus, t engine.MVCCStats) float64 { return float64(t.KeyBytes) }},
+	{"valbytes", func(_ *storeStatus, t engine.MVCCStats) float64 { return float64(t.ValBytes) }},
+	{"intentbytes", func(_ *storeStatus, t engine.MVCCStats) float64 { return float64(t.IntentBytes) }},
+	{"livecount", func(_ *storeStatus, t engine.MVCCStats) float64 { return float64(t.LiveCount) }},
+	{"keycount", func(_ *storeStatus, t engine.MVCCStats) float64 { return float64(t.KeyCount) }},
+	{"valcount", func(_ *storeStatus, t engine.MVCCStats) float64 { return float64(t.ValCount) }},
+	{"intentcount", func(_ *storeStatus, t engine.MVCCStats) float64 { return float64(t.IntentCount) }},
+	{"intentage", func(_ *storeStatus, t engine.MVCCStats) float64 { return float64(t.IntentAge) }},
+	{"gcbytesage", func(_ *storeStatus, t engine.MVCCStats) float64 { return float64(t.GCBytesAge) }},
+	{"lastupdatenanos", func(_ *storeStatus, t engine.MVCCStats) float64 { return float64(t.LastUpdateNanos) }},
+	{"ranges", func(s *storeStatus, _ engine.MVCCStats) float64 { return float64(len(s.ranges)) }},
+	{"ranges.leader", func(s *storeStatus, _ engine.MVCCStats) float64 { return float64(s.leaderRangeCount) }},
+	{"ranges.available", func(s *storeStatus, _ engine.MVCCStats) float64 { return float64(s.availableRangeCount) }},
+	{"ranges.replicated", func(s *storeStatus, _ engine.MVCCStats) float64 { return float64(s.replicatedRangeCount) }},
+}
+
+// nodeStat describes a single node-level statistic, analogous to storeStat.
+type nodeStat struct {
+	name  string
+	kind  string // Prometheus metric kind: "gauge" or "counter".
+	value func(node *nodeStatus) float64
+}
+
+// nodeStats enumerates every node-level statistic emitted by the recorder.
+var nodeStats = []nodeStat{
+	{"calls.success", "counter", func(n *nodeStatus) float64 { return float64(n.calls.success) }},
+	{"calls.error", "counter", func(n *nodeStatus) float64 { return float64(n.calls.err) }},
+}
+
+// latencyStats summarizes a method's call latency window, analogous to a
+// Prometheus summary: a handful of quantiles plus the raw count and sum
+// needed to compute an average.
+type latencyStats struct {
+	p50, p90, p99 time.Duration
+	count         int
+	sum           time.Duration
+}
+
+// quantile returns the requested quantile (in [0, 1]) of samples, which
+// must already be sorted in ascending order.
+func quantile(samples []time.Duration, q float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	idx := int(q * float64(len(samples)-1))
+	return samples[idx]
+}
+
+// computeLatencyStats summarizes an unsorted slice of latency samples.
+func computeLatencyStats(samples []time.Duration) latencyStats {
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	var sum time.Duration
+	for _, s := range samples {
+		sum += s
+	}
+	return latencyStats{
+		p50:   quantile(samples, 0.5),
+		p90:   quantile(samples, 0.9),
+		p99:   quantile(samples, 0.99),
+		count: len(samples),
+		sum:   sum,
+	}
+}
+
+// latencyStatFields enumerates the individual time series/metrics emitted
+// for each (node, method) latency window.
+var latencyStatFields = []struct {
+	suffix string
+	value  func(latencyStats) float64
+}{
+	{"p50", func(s latencyStats) float64 { return float64(s.p50) }},
+	{"p90", func(s latencyStats) float64 { return float64(s.p90) }},
+	{"p99", func(s latencyStats) float64 { return float64(s.p99) }},
+	{"count", func(s latencyStats) float64 { return float64(s.count) }},
+	{"sum", func(s latencyStats) float64 { return float64(s.sum) }},
+}
+
+// methodName returns the name used to identify method in generated
+// statistic names.
+func methodName(method proto.Method) string {
+	return fmt.Sprintf("%v", method)
+}
+
+// NodeStatusRecorder generates time series data from the information
+// accumulated in a NodeStatusMonitor. Each call to GetTimeSeriesData returns
+// a single data point per tracked statistic, timestamped with the recorder's
+// clock; GetPrometheusMetrics writes one untimestamped sample per tracked
+// statistic. Tick additionally fans the same
+// snapshot out to any Sinks registered via RegisterSink, and resets the
+// per-method latency windows for the next recording interval.
+type NodeStatusRecorder struct {
+	monitor *NodeStatusMonitor
+	clock   *hlc.Clock
+	nodeID  proto.NodeID
+
+	sinkMu sync.Mutex
+	sinks  []*sinkWorker
+}
+
+// NewNodeStatusRecorder instantiates a new NodeStatusRecorder which
+// generates time series data from the given monitor.
+func NewNodeStatusRecorder(monitor *NodeStatusMonitor, clock *hlc.Clock) *NodeStatusRecorder {
+	return &NodeStatusRecorder{
+		monitor: monitor,
+		clock:   clock,
+	}
+}
+
+// SetNodeID sets the ID of the node to which this recorder's
+// locally-generated statistics should be attributed.
+func (nsr *NodeStatusRecorder) SetNodeID(nodeID proto.NodeID) {
+	nsr.nodeID = nodeID
+}
+
+// RegisterSink adds sink to the set of sinks that receive a copy of every
+// snapshot generated by Tick. Each sink is driven from its own goroutine
+// with its own bounded queue, so a slow or failing sink cannot stall Tick
+// or any other registered sink. Stop must be called to terminate these
+// goroutines once the recorder is no longer in use.
+func (nsr *NodeStatusRecorder) RegisterSink(sink Sink) {
+	nsr.sinkMu.Lock()
+	defer nsr.sinkMu.Unlock()
+	nsr.sinks = append(nsr.sinks, newSinkWorker(sink))
+}
+
+// Stop terminates the delivery goroutine for every sink registered via
+// RegisterSink. It must be called before discarding a recorder that has
+// ever had a sink registered, to avoid leaking those goroutines. No further
+// calls to Tick or RegisterSink should be made afterward.
+func (nsr *NodeStatusRecorder) Stop() {
+	nsr.sinkMu.Lock()
+	defer nsr.sinkMu.Unlock()
+	for _, w := range nsr.sinks {
+		w.stop()
+	}
+	nsr.sinks = nil
+}
+
+// Tick generates the current time series snapshot, exactly as
+// GetTimeSeriesData does, fans it out to every sink registered via
+// RegisterSink, and resets the per-method latency windows so the next
+// recording interval's quantiles start fresh.
+func (nsr *NodeStatusRecorder) Tick() {
+	data := nsr.GetTimeSeriesData()
+	nsr.monitor.resetLatencyWindows()
+	nsr.sinkMu.Lock()
+	defer nsr.sinkMu.Unlock()
+	for _, w := range nsr.sinks {
+		w.offer(data)
+	}
+}
+
+// GetTimeSeriesData returns a slice of proto.TimeSeriesData, containing one
+// data point for every tracked statistic on every known store and node.
+func (nsr *NodeStatusRecorder) GetTimeSeriesData() []proto.TimeSeriesData {
+	nsr.monitor.Lock()
+	defer nsr.monitor.Unlock()
+
+	now := nsr.clock.Now().WallTime
+	var data []proto.TimeSeriesData
+	addDatapoint := func(name string, val float64) {
+		data = append(data, proto.TimeSeriesData{
+			Name: name,
+			Datapoints: []*proto.TimeSeriesDatapoint{
+				{
+					TimestampNanos: now,
+					Value:          val,
+				},
+			},
+		})
+	}
+
+	for _, store := range nsr.monitor.stores {
+		totals := sumMVCCStats(store.ranges)
+		for _, stat := range storeStats {
+			addDatapoint(fmt.Sprintf(storeTimeSeriesNameFmt, stat.name, store.storeID), stat.value(store, totals))
+		}
+	}
+	for _, node := range nsr.monitor.nodes {
+		for _, stat := range nodeStats {
+			addDatapoint(fmt.Sprintf(nodeTimeSeriesNameFmt, stat.name, node.nodeID), stat.value(node))
+		}
+		for method, ml := range node.methods {
+			stats := computeLatencyStats(ml.snapshot())
+			prefix := fmt.Sprintf("calls.latency.%s.", methodName(method))
+			for _, field := range latencyStatFields {
+				addDatapoint(fmt.Sprintf(nodeTimeSeriesNameFmt, prefix+field.suffix, node.nodeID), field.value(stats))
+			}
+		}
+	}
+
+	active, retries, commitLatency := nsr.monitor.txnAggregatesLocked()
+	addDatapoint(fmt.Sprintf(nodeTimeSeriesNameFmt, "txns.active", nsr.nodeID), float64(active))
+	addDatapoint(fmt.Sprintf(nodeTimeSeriesNameFmt, "txns.retries", nsr.nodeID), float64(retries))
+	addDatapoint(fmt.Sprintf(nodeTimeSeriesNameFmt, "txns.commit_latency", nsr.nodeID), float64(commitLatency))
+	return data
+}
+
+// sortedStoreIDs returns the keys of stores in ascending order, so that
+// exposition formats with a stable ordering (e.g. Prometheus text output)
+// are deterministic.
+func sortedStoreIDs(stores map[proto.StoreID]*storeStatus) []proto.StoreID {
+	ids := make([]proto.StoreID, 0, len(stores))
+	for id := range stores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// sortedNodeIDs returns the keys of nodes in ascending order.
+func sortedNodeIDs(nodes map[proto.NodeID]*nodeStatus) []proto.NodeID {
+	ids := make([]proto.NodeID, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// promName converts an internal statistic name (which may use dots to
+// separate components, e.g. "ranges.leader") into a valid Prometheus metric
+// name component.
+func promName(name string) string {
+	return strings.Replace(name, ".", "_", -1)
+}
+
+// GetPrometheusMetrics writes the recorder's current statistics to w in the
+// Prometheus text exposition format, covering the same per-store and
+// per-node accumulators as GetTimeSeriesData: MVCC stats and range counts
+// are exposed as gauges, call counters as counters. Callers are responsible
+// for serving w's output from an admin endpoint (e.g. /_status/vars); no
+// such endpoint is registered here.
+func (nsr *NodeStatusRecorder) GetPrometheusMetrics(w io.Writer) error {
+	nsr.monitor.Lock()
+	defer nsr.monitor.Unlock()
+
+	storeIDs := sortedStoreIDs(nsr.monitor.stores)
+	for _, stat := range storeStats {
+		name := "cockroach_store_" + promName(stat.name)
+		if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n", name); err != nil {
+			return err
+		}
+		for _, id := range storeIDs {
+			store := nsr.monitor.stores[id]
+			totals := sumMVCCStats(store.ranges)
+			if _, err := fmt.Fprintf(w, "%s{store=\"%d\"} %v\n", name, id, stat.value(store, totals)); err != nil {
+				return err
+			}
+		}
+	}
+
+	nodeIDs := sortedNodeIDs(nsr.monitor.nodes)
+	for _, stat := range nodeStats {
+		name := "cockroach_node_" + promName(stat.name)
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, stat.kind); err != nil {
+			return err
+		}
+		for _, id := range nodeIDs {
+			node := nsr.monitor.nodes[id]
+			if _, err := fmt.Fprintf(w, "%s{node=\"%d\"} %v\n", name, id, stat.value(node)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Precompute each node's latency stats once per method, then emit grouped
+	// by metric name (method, field) with nodes nested underneath, matching
+	// the store/node sections above: every metric's "# TYPE" line and all of
+	// its samples must form one contiguous block, per the Prometheus text
+	// exposition format.
+	methodStats := make(map[proto.NodeID]map[proto.Method]latencyStats, len(nodeIDs))
+	seenMethods := make(map[proto.Method]struct{})
+	for _, id := range nodeIDs {
+		node := nsr.monitor.nodes[id]
+		stats := make(map[proto.Method]latencyStats, len(node.methods))
+		for method, ml := range node.methods {
+			seenMethods[method] = struct{}{}
+			stats[method] = computeLatencyStats(ml.snapshot())
+		}
+		methodStats[id] = stats
+	}
+	methods := make([]proto.Method, 0, len(seenMethods))
+	for method := range seenMethods {
+		methods = append(methods, method)
+	}
+	sort.Slice(methods, func(i, j int) bool { return methodName(methods[i]) < methodName(methods[j]) })
+
+	for _, method := range methods {
+		base := "cockroach_node_calls_latency_" + promName(methodName(method))
+		for _, field := range latencyStatFields {
+			name := base + "_" + field.suffix
+			if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n", name); err != nil {
+				return err
+			}
+			for _, id := range nodeIDs {
+				stats, ok := methodStats[id][method]
+				if !ok {
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "%s{node=\"%d\"} %v\n", name, id, field.value(stats)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	active, retries, commitLatency := nsr.monitor.txnAggregatesLocked()
+	for _, m := range []struct {
+		name string
+		val  float64
+	}{
+		{"cockroach_node_txns_active", float64(active)},
+		{"cockroach_node_txns_retries", float64(retries)},
+		{"cockroach_node_txns_commit_latency", float64(commitLatency)},
+	} {
+		if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n", m.name); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s{node=\"%d\"} %v\n", m.name, nsr.nodeID, m.val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
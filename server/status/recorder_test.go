@@ -18,33 +18,31 @@
 package status
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"github.com/cockroachdb/cockroach/proto"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/leaktest"
+	"github.com/cockroachdb/cockroach/util/uuid"
 )
 
-type byTimeAndName []proto.TimeSeriesData
-
-func (a byTimeAndName) Len() int      { return len(a) }
-func (a byTimeAndName) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a byTimeAndName) Less(i, j int) bool {
-	if a[i].Name != a[j].Name {
-		return a[i].Name < a[j].Name
-	}
-	return a[i].Datapoints[0].TimestampNanos < a[j].Datapoints[0].TimestampNanos
-}
-
-// TestNodeStatusRecorder verifies that the time series data generated by a
-// recorder matches the data added to the monitor.
-func TestNodeStatusRecorder(t *testing.T) {
-	defer leaktest.AfterTest(t)
+// populateTestMonitor replays a fixed sequence of monitor events, used by
+// both TestNodeStatusRecorder and TestNodeStatusRecorderGetPrometheusMetrics
+// so that the two exporters are verified against identical input.
+func populateTestMonitor(monitor *NodeStatusMonitor) {
 	desc1 := &proto.RangeDescriptor{
 		RaftID:   1,
 		StartKey: proto.Key("a"),
@@ -69,13 +67,6 @@ func TestNodeStatusRecorder(t *testing.T) {
 		LastUpdateNanos: 1 * 1E9,
 	}
 
-	// Create a monitor and a recorder which uses the monitor.
-	monitor := NewNodeStatusMonitor()
-	manual := hlc.NewManualClock(100)
-	recorder := NewNodeStatusRecorder(monitor, hlc.NewClock(manual.UnixNano))
-	recorder.SetNodeID(proto.NodeID(1))
-
-	// Add some data to the monitor by simulating incoming events.
 	monitor.OnBeginScanRanges(&storage.BeginScanRangesEvent{
 		StoreID: proto.StoreID(1),
 	})
@@ -124,7 +115,7 @@ func TestNodeStatusRecorder(t *testing.T) {
 		AvailableRangeCount:  2,
 		ReplicatedRangeCount: 0,
 	})
-	// Node Events.
+	// Node events.
 	monitor.OnCallSuccess(&CallSuccessEvent{
 		NodeID: proto.NodeID(1),
 		Method: proto.Get,
@@ -137,6 +128,32 @@ func TestNodeStatusRecorder(t *testing.T) {
 		NodeID: proto.NodeID(1),
 		Method: proto.Scan,
 	})
+}
+
+type byTimeAndName []proto.TimeSeriesData
+
+func (a byTimeAndName) Len() int      { return len(a) }
+func (a byTimeAndName) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byTimeAndName) Less(i, j int) bool {
+	if a[i].Name != a[j].Name {
+		return a[i].Name < a[j].Name
+	}
+	return a[i].Datapoints[0].TimestampNanos < a[j].Datapoints[0].TimestampNanos
+}
+
+// TestNodeStatusRecorder verifies that the time series data generated by a
+// recorder matches the data added to the monitor.
+func TestNodeStatusRecorder(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	// Create a monitor and a recorder which uses the monitor.
+	monitor := NewNodeStatusMonitor()
+	manual := hlc.NewManualClock(100)
+	recorder := NewNodeStatusRecorder(monitor, hlc.NewClock(manual.UnixNano))
+	recorder.SetNodeID(proto.NodeID(1))
+
+	// Add some data to the monitor by simulating incoming events.
+	populateTestMonitor(monitor)
 
 	generateNodeData := func(nodeId int, name string, time, val int64) proto.TimeSeriesData {
 		return proto.TimeSeriesData{
@@ -204,6 +221,25 @@ func TestNodeStatusRecorder(t *testing.T) {
 		generateNodeData(1, "calls.success", 100, 2),
 		generateNodeData(1, "calls.error", 100, 1),
 	}
+	// Each method invoked above (Get, Put, Scan) contributed a single,
+	// zero-duration sample to its latency window.
+	for _, method := range []proto.Method{proto.Get, proto.Put, proto.Scan} {
+		prefix := fmt.Sprintf("calls.latency.%s.", methodName(method))
+		expected = append(expected,
+			generateNodeData(1, prefix+"p50", 100, 0),
+			generateNodeData(1, prefix+"p90", 100, 0),
+			generateNodeData(1, prefix+"p99", 100, 0),
+			generateNodeData(1, prefix+"count", 100, 1),
+			generateNodeData(1, prefix+"sum", 100, 0),
+		)
+	}
+	// None of the calls above carried a TxnID, so none are attributed to a
+	// tracked transaction at all.
+	expected = append(expected,
+		generateNodeData(1, "txns.active", 100, 0),
+		generateNodeData(1, "txns.retries", 100, 0),
+		generateNodeData(1, "txns.commit_latency", 100, 0),
+	)
 
 	actual := recorder.GetTimeSeriesData()
 	sort.Sort(byTimeAndName(actual))
@@ -211,4 +247,426 @@ func TestNodeStatusRecorder(t *testing.T) {
 	if a, e := actual, expected; !reflect.DeepEqual(a, e) {
 		t.Errorf("recorder did not yield expected time series collection; expected %v, got %v", e, a)
 	}
+
+	// The same data should also be deliverable through a registered Sink.
+	sink := newCaptureSink()
+	recorder.RegisterSink(sink)
+	defer recorder.Stop()
+	recorder.Tick()
+
+	select {
+	case viaSink := <-sink.dataCh:
+		sort.Sort(byTimeAndName(viaSink))
+		if !reflect.DeepEqual(viaSink, expected) {
+			t.Errorf("sink did not receive expected time series collection; expected %v, got %v", expected, viaSink)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for sink to receive recorded data")
+	}
+}
+
+// TestNodeStatusRecorderStop verifies that Stop terminates every registered
+// sink's delivery goroutine, so that it does not leak past the recorder's
+// own lifetime.
+func TestNodeStatusRecorderStop(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	monitor := NewNodeStatusMonitor()
+	manual := hlc.NewManualClock(100)
+	recorder := NewNodeStatusRecorder(monitor, hlc.NewClock(manual.UnixNano))
+	recorder.SetNodeID(proto.NodeID(1))
+
+	sink := newCaptureSink()
+	recorder.RegisterSink(sink)
+	recorder.Tick()
+	<-sink.dataCh
+
+	recorder.Stop()
+}
+
+// captureSink is a Sink that delivers each Emit call's data over a channel,
+// for use in tests that need to synchronize with the asynchronous sink
+// worker driving it.
+type captureSink struct {
+	dataCh chan []proto.TimeSeriesData
+}
+
+func newCaptureSink() *captureSink {
+	return &captureSink{dataCh: make(chan []proto.TimeSeriesData, 1)}
+}
+
+// Emit implements Sink.
+func (s *captureSink) Emit(_ context.Context, data []proto.TimeSeriesData) error {
+	s.dataCh <- data
+	return nil
+}
+
+// promMetricLine matches a single Prometheus exposition line of the form
+// emitted by GetPrometheusMetrics, e.g. `cockroach_store_livebytes{store="1"} 3`.
+var promMetricLine = regexp.MustCompile(`^(\w+)\{(?:store|node)="(\d+)"\} (.+)$`)
+
+// parsePrometheusMetrics parses the text emitted by GetPrometheusMetrics into
+// a map from "<metric>{<id>}" to its value, ignoring HELP/TYPE comment lines.
+func parsePrometheusMetrics(t *testing.T, text string) map[string]float64 {
+	parsed := make(map[string]float64)
+	for _, line := range bytes.Split([]byte(text), []byte("\n")) {
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		m := promMetricLine.FindSubmatch(line)
+		if m == nil {
+			t.Fatalf("could not parse prometheus metric line: %q", line)
+		}
+		val, err := strconv.ParseFloat(string(m[3]), 64)
+		if err != nil {
+			t.Fatalf("could not parse value in line %q: %v", line, err)
+		}
+		parsed[fmt.Sprintf("%s{%s}", m[1], m[2])] = val
+	}
+	return parsed
+}
+
+// TestNodeStatusRecorderGetPrometheusMetrics verifies that the Prometheus
+// exposition generated for a recorder agrees, label-for-label and
+// value-for-value, with the same recorder's GetTimeSeriesData output.
+func TestNodeStatusRecorderGetPrometheusMetrics(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	monitor := NewNodeStatusMonitor()
+	manual := hlc.NewManualClock(100)
+	recorder := NewNodeStatusRecorder(monitor, hlc.NewClock(manual.UnixNano))
+	recorder.SetNodeID(proto.NodeID(1))
+	populateTestMonitor(monitor)
+
+	var buf bytes.Buffer
+	if err := recorder.GetPrometheusMetrics(&buf); err != nil {
+		t.Fatalf("GetPrometheusMetrics returned an error: %v", err)
+	}
+	promMetrics := parsePrometheusMetrics(t, buf.String())
+
+	for _, ts := range recorder.GetTimeSeriesData() {
+		// Time series names look like "cr.store.livebytes-1" or
+		// "cr.node.calls.success-1"; translate that into the Prometheus
+		// "cockroach_<store|node>_<stat>{<store|node>}" form.
+		var prefix, suffix string
+		switch {
+		case strings.HasPrefix(ts.Name, "cr.store."):
+			prefix, suffix = "cockroach_store_", strings.TrimPrefix(ts.Name, "cr.store.")
+		case strings.HasPrefix(ts.Name, "cr.node."):
+			prefix, suffix = "cockroach_node_", strings.TrimPrefix(ts.Name, "cr.node.")
+		default:
+			t.Fatalf("unrecognized time series name %q", ts.Name)
+		}
+		dash := strings.LastIndex(suffix, "-")
+		stat, id := suffix[:dash], suffix[dash+1:]
+		metric := fmt.Sprintf("%s{%s}", prefix+promName(stat), id)
+
+		val, ok := promMetrics[metric]
+		if !ok {
+			t.Errorf("prometheus output missing metric %s (from time series %s)", metric, ts.Name)
+			continue
+		}
+		if expected := ts.Datapoints[0].Value; val != expected {
+			t.Errorf("metric %s: got %v, expected %v (from time series %s)", metric, val, expected, ts.Name)
+		}
+	}
+}
+
+// TestNodeStatusRecorderGetPrometheusMetricsGroupsByMetric verifies that,
+// with more than one node tracking the same method, every metric's "# TYPE"
+// line and all of its samples form one contiguous block, as the Prometheus
+// text exposition format requires.
+func TestNodeStatusRecorderGetPrometheusMetricsGroupsByMetric(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	monitor := NewNodeStatusMonitor()
+	manual := hlc.NewManualClock(100)
+	recorder := NewNodeStatusRecorder(monitor, hlc.NewClock(manual.UnixNano))
+	recorder.SetNodeID(proto.NodeID(1))
+
+	monitor.OnCallSuccess(&CallSuccessEvent{NodeID: proto.NodeID(1), Method: proto.Get})
+	monitor.OnCallSuccess(&CallSuccessEvent{NodeID: proto.NodeID(2), Method: proto.Get})
+
+	var buf bytes.Buffer
+	if err := recorder.GetPrometheusMetrics(&buf); err != nil {
+		t.Fatalf("GetPrometheusMetrics returned an error: %v", err)
+	}
+
+	typeLine := regexp.MustCompile(`^# TYPE (\S+) `)
+	sampleLine := regexp.MustCompile(`^(\w+)\{`)
+
+	seen := make(map[string]bool)
+	var last string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		var name string
+		switch {
+		case typeLine.MatchString(line):
+			name = typeLine.FindStringSubmatch(line)[1]
+		case sampleLine.MatchString(line):
+			name = sampleLine.FindStringSubmatch(line)[1]
+		default:
+			t.Fatalf("could not parse prometheus output line: %q", line)
+		}
+		if name != last {
+			if seen[name] {
+				t.Fatalf("metric %s is split across non-contiguous blocks in prometheus output:\n%s", name, buf.String())
+			}
+			seen[name] = true
+			last = name
+		}
+	}
+}
+
+// TestNodeStatusRecorderLatencyQuantiles verifies that GetTimeSeriesData
+// reports latency quantiles that fall within the expected error bounds for a
+// synthetic, uniformly distributed set of call latencies.
+func TestNodeStatusRecorderLatencyQuantiles(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	monitor := NewNodeStatusMonitor()
+	manual := hlc.NewManualClock(100)
+	recorder := NewNodeStatusRecorder(monitor, hlc.NewClock(manual.UnixNano))
+	recorder.SetNodeID(proto.NodeID(1))
+
+	// Feed a uniform distribution of latencies from 1ms to latencyWindowSize
+	// ms; with exactly latencyWindowSize samples retained, the windowed
+	// quantiles should match the true distribution's quantiles to within one
+	// sample.
+	const samples = latencyWindowSize
+	for i := 1; i <= samples; i++ {
+		monitor.OnCallSuccess(&CallSuccessEvent{
+			NodeID:   proto.NodeID(1),
+			Method:   proto.Get,
+			Duration: time.Duration(i) * time.Millisecond,
+		})
+	}
+
+	const errorBoundMillis = float64(samples) * 0.01 // 1% of the sample range.
+	wantQuantileMillis := func(q, wantMillis float64) {
+		name := fmt.Sprintf(nodeTimeSeriesNameFmt, fmt.Sprintf("calls.latency.%s.p%d", methodName(proto.Get), int(q*100)), proto.NodeID(1))
+		for _, ts := range recorder.GetTimeSeriesData() {
+			if ts.Name != name {
+				continue
+			}
+			gotMillis := time.Duration(ts.Datapoints[0].Value).Seconds() * 1000
+			if diff := gotMillis - wantMillis; diff < -errorBoundMillis || diff > errorBoundMillis {
+				t.Errorf("%s: got %vms, want ~%vms (+/- %vms)", name, gotMillis, wantMillis, errorBoundMillis)
+			}
+			return
+		}
+		t.Fatalf("time series %s not found", name)
+	}
+
+	wantQuantileMillis(0.5, float64(samples)*0.5)
+	wantQuantileMillis(0.9, float64(samples)*0.9)
+	wantQuantileMillis(0.99, float64(samples)*0.99)
+}
+
+// TestMethodLatencyWindowing verifies that samples older than
+// latencyWindowDuration are excluded from snapshot.
+func TestMethodLatencyWindowing(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	realNow := latencyNow
+	fakeNow := realNow()
+	latencyNow = func() time.Time { return fakeNow }
+	defer func() { latencyNow = realNow }()
+
+	var ml methodLatency
+	ml.record(10 * time.Millisecond)
+
+	fakeNow = fakeNow.Add(latencyWindowDuration + time.Second)
+	ml.record(20 * time.Millisecond)
+
+	samples := ml.snapshot()
+	if len(samples) != 1 || samples[0] != 20*time.Millisecond {
+		t.Errorf("expected only the sample recorded within the window to remain, got %v", samples)
+	}
+}
+
+// TestNodeStatusRecorderTickResetsLatencyWindow verifies that Tick clears
+// the per-method latency windows, so quantiles for the next recording
+// interval only reflect calls made since the tick.
+func TestNodeStatusRecorderTickResetsLatencyWindow(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	monitor := NewNodeStatusMonitor()
+	manual := hlc.NewManualClock(100)
+	recorder := NewNodeStatusRecorder(monitor, hlc.NewClock(manual.UnixNano))
+	recorder.SetNodeID(proto.NodeID(1))
+
+	monitor.OnCallSuccess(&CallSuccessEvent{
+		NodeID:   proto.NodeID(1),
+		Method:   proto.Get,
+		Duration: 10 * time.Millisecond,
+	})
+
+	recorder.Tick()
+
+	monitor.Lock()
+	samples := monitor.nodes[proto.NodeID(1)].methods[proto.Get].snapshot()
+	monitor.Unlock()
+	if len(samples) != 0 {
+		t.Errorf("expected Tick to reset the latency window, got %d samples", len(samples))
+	}
+}
+
+// TestNodeStatusMonitorTxnEviction verifies that tracked transactions are
+// evicted once the monitor exceeds maxTrackedTxns, and that a transaction
+// untouched for longer than txnIdleTimeout is evicted on the next touch even
+// when well under the size limit.
+func TestNodeStatusMonitorTxnEviction(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	monitor := NewNodeStatusMonitor()
+	for i := 0; i < maxTrackedTxns+10; i++ {
+		monitor.OnCallSuccess(&CallSuccessEvent{
+			NodeID: proto.NodeID(1),
+			Method: proto.Get,
+			TxnID:  uuid.NewV4(),
+		})
+	}
+	if active := monitor.txnOrder.Len(); active != maxTrackedTxns {
+		t.Errorf("expected %d tracked transactions after exceeding the size limit, got %d", maxTrackedTxns, active)
+	}
+
+	// Idle eviction scans from the least recently touched end of the LRU, so
+	// exercise it on a fresh monitor where the stale entry is the oldest.
+	monitor = NewNodeStatusMonitor()
+	staleID := uuid.NewV4()
+	monitor.Lock()
+	txn := monitor.touchTxnLocked(staleID)
+	txn.lastSeen = txn.lastSeen.Add(-2 * txnIdleTimeout)
+	monitor.Unlock()
+
+	monitor.OnCallSuccess(&CallSuccessEvent{
+		NodeID: proto.NodeID(1),
+		Method: proto.Get,
+		TxnID:  uuid.NewV4(),
+	})
+
+	monitor.Lock()
+	_, stillTracked := monitor.txns[staleID]
+	monitor.Unlock()
+	if stillTracked {
+		t.Error("expected stale transaction to be evicted, but it is still tracked")
+	}
+}
+
+// TestNodeStatusMonitorTxnIgnoresCallsWithoutTxnID verifies that calls made
+// with the zero-value TxnID (i.e. outside of an explicit transaction) are
+// excluded from transaction accounting entirely, rather than collapsing
+// into one shared phantom transaction.
+func TestNodeStatusMonitorTxnIgnoresCallsWithoutTxnID(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	monitor := NewNodeStatusMonitor()
+	monitor.OnCallSuccess(&CallSuccessEvent{NodeID: proto.NodeID(1), Method: proto.Get})
+	monitor.OnCallError(&CallErrorEvent{NodeID: proto.NodeID(1), Method: proto.Scan, Retryable: true})
+
+	monitor.Lock()
+	active, retries, _ := monitor.txnAggregatesLocked()
+	monitor.Unlock()
+	if active != 0 || retries != 0 {
+		t.Errorf("expected calls without a TxnID to be excluded from transaction accounting, got active=%d retries=%d", active, retries)
+	}
+}
+
+// TestNodeStatusMonitorTxnActiveExcludesCommitted verifies that a committed
+// transaction no longer counts toward txns.active, even though it remains
+// in the LRU (and so still contributes to its commit latency) until it is
+// evicted by size or idle time.
+func TestNodeStatusMonitorTxnActiveExcludesCommitted(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	monitor := NewNodeStatusMonitor()
+	txnID := uuid.NewV4()
+
+	monitor.OnCallSuccess(&CallSuccessEvent{NodeID: proto.NodeID(1), Method: proto.Get, TxnID: txnID})
+	monitor.Lock()
+	active, _, _ := monitor.txnAggregatesLocked()
+	monitor.Unlock()
+	if active != 1 {
+		t.Errorf("expected the in-flight transaction to be counted as active, got %d", active)
+	}
+
+	monitor.OnCallSuccess(&CallSuccessEvent{NodeID: proto.NodeID(1), Method: proto.EndTransaction, TxnID: txnID})
+	monitor.Lock()
+	active, _, commitLatency := monitor.txnAggregatesLocked()
+	_, stillTracked := monitor.txns[txnID]
+	monitor.Unlock()
+	if active != 0 {
+		t.Errorf("expected the committed transaction to no longer be counted as active, got %d", active)
+	}
+	if !stillTracked {
+		t.Error("expected the committed transaction to remain in the LRU until evicted")
+	}
+	if commitLatency < 0 {
+		t.Errorf("expected a non-negative commit latency, got %v", commitLatency)
+	}
+}
+
+// TestNodeStatusMonitorTxnRetriesOnlyCountRetryableErrors verifies that a
+// failed call only counts as a retry when it is reported as Retryable; a
+// permanent failure does not inflate txns.retries.
+func TestNodeStatusMonitorTxnRetriesOnlyCountRetryableErrors(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	monitor := NewNodeStatusMonitor()
+	txnID := uuid.NewV4()
+
+	monitor.OnCallError(&CallErrorEvent{NodeID: proto.NodeID(1), Method: proto.Put, TxnID: txnID, Retryable: false})
+	monitor.Lock()
+	retries := monitor.txns[txnID].Value.(*txnStatus).retries
+	monitor.Unlock()
+	if retries != 0 {
+		t.Errorf("a non-retryable error should not count as a retry, got %d", retries)
+	}
+
+	monitor.OnCallError(&CallErrorEvent{NodeID: proto.NodeID(1), Method: proto.Put, TxnID: txnID, Retryable: true})
+	monitor.Lock()
+	retries = monitor.txns[txnID].Value.(*txnStatus).retries
+	monitor.Unlock()
+	if retries != 1 {
+		t.Errorf("a retryable error should count as a retry, got %d", retries)
+	}
+}
+
+// TestNodeStatusMonitorTxnConcurrency verifies that concurrent calls to
+// OnCallSuccess attributed to the same transaction are aggregated correctly.
+func TestNodeStatusMonitorTxnConcurrency(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	monitor := NewNodeStatusMonitor()
+	txnID := uuid.NewV4()
+
+	const callsPerGoroutine = 50
+	const goroutines = 10
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < callsPerGoroutine; j++ {
+				monitor.OnCallSuccess(&CallSuccessEvent{
+					NodeID: proto.NodeID(1),
+					Method: proto.Get,
+					TxnID:  txnID,
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	monitor.Lock()
+	txn := monitor.txns[txnID].Value.(*txnStatus)
+	count := txn.callCounts[proto.Get]
+	monitor.Unlock()
+
+	if want := int64(callsPerGoroutine * goroutines); count != want {
+		t.Errorf("expected %d aggregated calls for the transaction, got %d", want, count)
+	}
 }
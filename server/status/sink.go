@@ -0,0 +1,80 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Matt Tracy (matt.r.tracy@gmail.com)
+
+package status
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// Sink is an egress path for recorded time series data. Emit is called once
+// per recording interval with every time series generated by that tick; it
+// should return promptly, since a sink that blocks only delays its own
+// queue, not the recorder or any other sink (see sinkWorker).
+type Sink interface {
+	Emit(context.Context, []proto.TimeSeriesData) error
+}
+
+// sinkQueueDepth bounds the number of pending snapshots buffered for a
+// single sink. Once full, Tick drops new snapshots for that sink rather
+// than blocking.
+const sinkQueueDepth = 8
+
+// sinkWorker drives a single Sink from its own goroutine and queue, so that
+// a slow or blocked sink cannot stall Tick or any other registered sink.
+type sinkWorker struct {
+	sink  Sink
+	queue chan []proto.TimeSeriesData
+}
+
+func newSinkWorker(sink Sink) *sinkWorker {
+	w := &sinkWorker{
+		sink:  sink,
+		queue: make(chan []proto.TimeSeriesData, sinkQueueDepth),
+	}
+	go w.run()
+	return w
+}
+
+func (w *sinkWorker) run() {
+	for data := range w.queue {
+		if err := w.sink.Emit(context.Background(), data); err != nil {
+			log.Errorf("status sink %T failed to emit: %s", w.sink, err)
+		}
+	}
+}
+
+// offer enqueues data for delivery, dropping it if the sink's queue is
+// already full. The caller must not call offer after stop.
+func (w *sinkWorker) offer(data []proto.TimeSeriesData) {
+	select {
+	case w.queue <- data:
+	default:
+		log.Warningf("status sink %T queue full; dropping a recording interval", w.sink)
+	}
+}
+
+// stop closes the worker's queue, causing run to drain any pending data and
+// return. The caller must ensure no concurrent or subsequent call to offer
+// races with stop; NodeStatusRecorder.Stop satisfies this by holding sinkMu
+// across both.
+func (w *sinkWorker) stop() {
+	close(w.queue)
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Matt Tracy (matt.r.tracy@gmail.com)
+
+package status
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/proto"
+)
+
+// TimeSeriesWriter is the subset of the internal time series store's client
+// used by TimeSeriesStoreSink: a store must implement it to be written to
+// through that sink.
+type TimeSeriesWriter interface {
+	StoreData(context.Context, []proto.TimeSeriesData) error
+}
+
+// TimeSeriesStoreSink is a Sink forwarding every recorded snapshot to the
+// internal time series store. It is not registered by default; callers add
+// it with RegisterSink like any other Sink.
+type TimeSeriesStoreSink struct {
+	db TimeSeriesWriter
+}
+
+// NewTimeSeriesStoreSink creates a Sink which forwards recorded samples to
+// db.
+func NewTimeSeriesStoreSink(db TimeSeriesWriter) *TimeSeriesStoreSink {
+	return &TimeSeriesStoreSink{db: db}
+}
+
+// Emit implements Sink.
+func (s *TimeSeriesStoreSink) Emit(ctx context.Context, data []proto.TimeSeriesData) error {
+	return s.db.StoreData(ctx, data)
+}
+
+// GraphiteSink is a Sink that forwards recorded samples to a Graphite (or
+// StatsD, which accepts the same plaintext line protocol for gauges) server
+// over UDP, in "<metric> <value> <unix-seconds>" lines.
+type GraphiteSink struct {
+	addr string
+}
+
+// NewGraphiteSink creates a Sink which writes to the Graphite/StatsD server
+// at addr (host:port) over UDP.
+func NewGraphiteSink(addr string) *GraphiteSink {
+	return &GraphiteSink{addr: addr}
+}
+
+// Emit implements Sink.
+func (s *GraphiteSink) Emit(_ context.Context, data []proto.TimeSeriesData) error {
+	conn, err := net.Dial("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	for _, ts := range data {
+		// Graphite's hierarchical namespace is dot-separated, which is
+		// exactly the format ts.Name is already in (e.g. "cr.store.livebytes-1").
+		for _, dp := range ts.Datapoints {
+			fmt.Fprintf(&buf, "%s %v %d\n", ts.Name, dp.Value, dp.TimestampNanos/1e9)
+		}
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+// openTSDBPoint is a single OpenTSDB "put" datapoint, as accepted by
+// OpenTSDB's /api/put HTTP endpoint.
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// OpenTSDBSink is a Sink that forwards recorded samples to an OpenTSDB (or
+// OpenTSDB-compatible) server's HTTP JSON ingestion endpoint.
+type OpenTSDBSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewOpenTSDBSink creates a Sink which POSTs to the OpenTSDB /api/put-style
+// endpoint at url.
+func NewOpenTSDBSink(url string) *OpenTSDBSink {
+	return &OpenTSDBSink{url: url, client: http.DefaultClient}
+}
+
+// Emit implements Sink.
+func (s *OpenTSDBSink) Emit(ctx context.Context, data []proto.TimeSeriesData) error {
+	points := make([]openTSDBPoint, 0, len(data))
+	for _, ts := range data {
+		for _, dp := range ts.Datapoints {
+			points = append(points, openTSDBPoint{
+				Metric:    ts.Name,
+				Timestamp: dp.TimestampNanos / 1e9,
+				Value:     dp.Value,
+				Tags:      map[string]string{},
+			})
+		}
+	}
+	body, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("opentsdb sink: unexpected response status %s", resp.Status)
+	}
+	return nil
+}
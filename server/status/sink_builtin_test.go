@@ -0,0 +1,125 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Matt Tracy (matt.r.tracy@gmail.com)
+
+package status
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util/leaktest"
+)
+
+func testSinkData() []proto.TimeSeriesData {
+	return []proto.TimeSeriesData{
+		{
+			Name: "cr.store.livebytes-1",
+			Datapoints: []*proto.TimeSeriesDatapoint{
+				{TimestampNanos: 5 * 1e9, Value: 42},
+			},
+		},
+	}
+}
+
+// TestGraphiteSinkEmit verifies that GraphiteSink writes one correctly
+// formatted line per datapoint to its configured UDP address.
+func TestGraphiteSinkEmit(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("could not listen for udp: %v", err)
+	}
+	defer conn.Close()
+
+	sink := NewGraphiteSink(conn.LocalAddr().String())
+	if err := sink.Emit(context.Background(), testSinkData()); err != nil {
+		t.Fatalf("Emit returned an error: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read from udp socket: %v", err)
+	}
+
+	if want, got := "cr.store.livebytes-1 42 5\n", string(buf[:n]); got != want {
+		t.Errorf("got line %q, want %q", got, want)
+	}
+}
+
+// TestOpenTSDBSinkEmit verifies that OpenTSDBSink POSTs the expected JSON
+// payload to its configured endpoint, and that a non-2xx response surfaces
+// as an error from Emit.
+func TestOpenTSDBSinkEmit(t *testing.T) {
+	defer leaktest.AfterTest(t)
+
+	var gotBody []byte
+	var gotContentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotContentType = r.Header.Get("Content-Type")
+		var err error
+		gotBody, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read request body: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	sink := NewOpenTSDBSink(srv.URL)
+	if err := sink.Emit(context.Background(), testSinkData()); err != nil {
+		t.Fatalf("Emit returned an error: %v", err)
+	}
+
+	if gotContentType != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", gotContentType)
+	}
+
+	var points []openTSDBPoint
+	if err := json.Unmarshal(gotBody, &points); err != nil {
+		t.Fatalf("could not unmarshal request body %q: %v", gotBody, err)
+	}
+	want := []openTSDBPoint{
+		{Metric: "cr.store.livebytes-1", Timestamp: 5, Value: 42, Tags: map[string]string{}},
+	}
+	if !reflect.DeepEqual(points, want) {
+		t.Errorf("got points %+v, want %+v", points, want)
+	}
+
+	// A non-2xx response should surface as an error.
+	failSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failSrv.Close()
+
+	failSink := NewOpenTSDBSink(failSrv.URL)
+	if err := failSink.Emit(context.Background(), testSinkData()); err == nil {
+		t.Error("expected an error from a non-2xx response, got nil")
+	} else if !strings.Contains(err.Error(), "500") {
+		t.Errorf("expected error to mention the response status, got %v", err)
+	}
+}
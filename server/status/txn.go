@@ -0,0 +1,151 @@
+// Copyright 2015 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Matt Tracy (matt.r.tracy@gmail.com)
+
+package status
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/cockroachdb/cockroach/proto"
+	"github.com/cockroachdb/cockroach/util/uuid"
+)
+
+const (
+	// maxTrackedTxns bounds the number of transactions the monitor will
+	// track at once; once exceeded, the least recently touched transaction
+	// is evicted regardless of age.
+	maxTrackedTxns = 1000
+	// txnIdleTimeout bounds how long a transaction is tracked without any
+	// call being attributed to it, so that a leaked or abandoned TxnID
+	// cannot pin an entry indefinitely.
+	txnIdleTimeout = 10 * time.Minute
+)
+
+// txnStatus accumulates the calls attributed to a single transaction.
+type txnStatus struct {
+	id         uuid.UUID
+	callCounts map[proto.Method]int64
+	latency    time.Duration
+	retries    int64
+
+	committed     bool
+	commitLatency time.Duration
+
+	lastSeen time.Time
+}
+
+// touchTxnLocked returns the txnStatus for id, creating it if necessary and
+// marking it as the most recently used transaction. It also evicts any
+// transactions that have become stale as a result. The monitor's lock must
+// be held.
+func (nsm *NodeStatusMonitor) touchTxnLocked(id uuid.UUID) *txnStatus {
+	if nsm.txns == nil {
+		nsm.txns = make(map[uuid.UUID]*list.Element)
+		nsm.txnOrder = list.New()
+	}
+	if el, ok := nsm.txns[id]; ok {
+		nsm.txnOrder.MoveToFront(el)
+		status := el.Value.(*txnStatus)
+		status.lastSeen = time.Now()
+		return status
+	}
+
+	status := &txnStatus{
+		id:         id,
+		callCounts: make(map[proto.Method]int64),
+		lastSeen:   time.Now(),
+	}
+	nsm.txns[id] = nsm.txnOrder.PushFront(status)
+	nsm.evictStaleTxnsLocked()
+	return status
+}
+
+// evictStaleTxnsLocked removes transactions beyond maxTrackedTxns or idle
+// for longer than txnIdleTimeout. The monitor's lock must be held.
+func (nsm *NodeStatusMonitor) evictStaleTxnsLocked() {
+	for nsm.txnOrder.Len() > maxTrackedTxns {
+		nsm.evictOldestTxnLocked()
+	}
+	now := time.Now()
+	for {
+		el := nsm.txnOrder.Back()
+		if el == nil || now.Sub(el.Value.(*txnStatus).lastSeen) <= txnIdleTimeout {
+			break
+		}
+		nsm.evictOldestTxnLocked()
+	}
+}
+
+// evictOldestTxnLocked removes the least recently touched transaction. The
+// monitor's lock must be held, and the transaction list must be non-empty.
+func (nsm *NodeStatusMonitor) evictOldestTxnLocked() {
+	el := nsm.txnOrder.Back()
+	status := nsm.txnOrder.Remove(el).(*txnStatus)
+	delete(nsm.txns, status.id)
+}
+
+// txnAggregatesLocked summarizes the currently tracked transactions: how
+// many are still live (i.e. not yet committed), their total retry count,
+// and, summed over those that have committed, the latency of each one's
+// EndTransaction call. A committed
+// transaction lingers in the LRU until it is evicted by size or idle time,
+// so it must be excluded from active rather than counted via txnOrder.Len.
+// The monitor's lock must be held.
+func (nsm *NodeStatusMonitor) txnAggregatesLocked() (active, retries int64, commitLatency time.Duration) {
+	if nsm.txnOrder == nil {
+		return 0, 0, 0
+	}
+	for el := nsm.txnOrder.Front(); el != nil; el = el.Next() {
+		txn := el.Value.(*txnStatus)
+		retries += txn.retries
+		if txn.committed {
+			commitLatency += txn.commitLatency
+		} else {
+			active++
+		}
+	}
+	return active, retries, commitLatency
+}
+
+// recordTxnCallLocked attributes a single call to its transaction, updating
+// the transaction's per-method call counts and cumulative latency. If the
+// call was a successful commit, it is additionally recorded as such.
+// Calls made outside of an explicit transaction (the zero-value TxnID) are
+// excluded entirely, so that they don't collapse into one shared phantom
+// transaction that would dominate the aggregates returned by
+// txnAggregatesLocked. retryable should be true only for an error that
+// represents a transaction restart; it is ignored for successful calls.
+// The monitor's lock must be held.
+func (nsm *NodeStatusMonitor) recordTxnCallLocked(
+	txnID uuid.UUID, method proto.Method, d time.Duration, retryable bool,
+) {
+	if txnID == (uuid.UUID{}) {
+		return
+	}
+	txn := nsm.touchTxnLocked(txnID)
+	txn.callCounts[method]++
+	txn.latency += d
+	if retryable {
+		txn.retries++
+		return
+	}
+	if method == proto.EndTransaction {
+		txn.committed = true
+		txn.commitLatency = d
+	}
+}